@@ -0,0 +1,178 @@
+package persistence
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+
+	"github.com/fnproject/completer/setup"
+)
+
+// maxCachedBatchSize bounds how many distinct prepared statements
+// batchInsertStmt will cache, since a pathological spread of batch sizes
+// would otherwise grow the statement cache without limit. Larger batches
+// still work, they just prepare a fresh (uncached) statement each time.
+const maxCachedBatchSize = 64
+
+const defaultBatchWindow = 5 * time.Millisecond
+
+func batchWindowFromEnv() time.Duration {
+	window := defaultBatchWindow
+	if v, err := strconv.Atoi(setup.GetString(setup.EnvDBBatchWindowMs)); err == nil {
+		window = time.Duration(v) * time.Millisecond
+	}
+	return window
+}
+
+// eventRow is a single PersistEvent call waiting to be flushed as part of a
+// multi-row insert.
+type eventRow struct {
+	eventIndex int
+	eventType  string
+	eventBytes []byte
+	codecName  string
+}
+
+// pendingBatch accumulates the events for one actor during a single batch
+// window before they're flushed together in one transaction.
+type pendingBatch struct {
+	mu    sync.Mutex
+	rows  []eventRow
+	timer *time.Timer
+}
+
+// enqueueEvent adds row to actorName's pending batch, starting the flush
+// timer for that actor if one isn't already running.
+func (provider *SqlProvider) enqueueEvent(actorName string, row eventRow) {
+	provider.batchMu.Lock()
+	batch, ok := provider.batches[actorName]
+	if !ok {
+		batch = &pendingBatch{}
+		provider.batches[actorName] = batch
+	}
+	// batch.mu is taken before batchMu is released so evictBatchIfIdle
+	// can't drop this batch between the lookup and the append below.
+	batch.mu.Lock()
+	provider.batchMu.Unlock()
+
+	batch.rows = append(batch.rows, row)
+	if batch.timer == nil {
+		batch.timer = time.AfterFunc(provider.batchWindow, func() {
+			provider.flushBatch(actorName, batch)
+		})
+	}
+	batch.mu.Unlock()
+}
+
+// flushBatch writes out everything accumulated for actorName since the last
+// flush. Events that fail to persist are handed to the provider's bounded
+// buffer (bufferEvent), which PersistEvent later drains via
+// maybeDrainBufferedEvents.
+func (provider *SqlProvider) flushBatch(actorName string, batch *pendingBatch) {
+	batch.mu.Lock()
+	rows := batch.rows
+	batch.rows = nil
+	batch.timer = nil
+	batch.mu.Unlock()
+
+	defer provider.evictBatchIfIdle(actorName, batch)
+
+	if len(rows) == 0 {
+		return
+	}
+
+	if err := provider.execBatchInsert(actorName, rows); err != nil {
+		log.WithFields(logrus.Fields{"actor_name": actorName, "batch_size": len(rows)}).WithError(err).Error("Failed to persist event batch, buffering for retry")
+		for _, r := range rows {
+			provider.bufferEvent(bufferedEvent{actorName: actorName, eventIndex: r.eventIndex, eventType: r.eventType, eventBytes: r.eventBytes, codecName: r.codecName})
+		}
+	}
+}
+
+// evictBatchIfIdle removes actorName's entry from provider.batches once
+// batch has gone idle (nothing queued, no timer pending), so an actor
+// system with high actor churn doesn't accumulate one batch entry per
+// distinct actor name ever seen. batchMu is held across both the idle
+// check and the delete so a concurrent enqueueEvent call can't re-arm
+// batch between the two: either enqueueEvent's batchMu section runs
+// first and this finds rows/timer set (so it leaves the entry alone), or
+// this runs first and enqueueEvent's lookup misses, creating a fresh
+// pendingBatch for the next event. The pointer identity check guards
+// against evicting a newer batch that enqueueEvent has already swapped
+// in for actorName by the time this runs.
+func (provider *SqlProvider) evictBatchIfIdle(actorName string, batch *pendingBatch) {
+	provider.batchMu.Lock()
+	defer provider.batchMu.Unlock()
+
+	batch.mu.Lock()
+	idle := len(batch.rows) == 0 && batch.timer == nil
+	batch.mu.Unlock()
+	if !idle {
+		return
+	}
+
+	if provider.batches[actorName] == batch {
+		delete(provider.batches, actorName)
+	}
+}
+
+func (provider *SqlProvider) execBatchInsert(actorName string, rows []eventRow) error {
+	stmt, cached, err := provider.batchInsertStmt(len(rows))
+	if err != nil {
+		return err
+	}
+	if !cached {
+		defer stmt.Close()
+	}
+
+	args := make([]interface{}, 0, len(rows)*5)
+	for _, r := range rows {
+		args = append(args, actorName, r.eventType, r.eventIndex, r.eventBytes, r.codecName)
+	}
+
+	return provider.execInTxWithRetry(stmt, args...)
+}
+
+// batchInsertStmt returns a prepared statement for a VALUES list of n rows,
+// preparing and caching it on first use for any size up to
+// maxCachedBatchSize. cached reports whether the returned statement lives in
+// provider.batchStmts; for n above maxCachedBatchSize a fresh statement is
+// prepared on every call and it's the caller's responsibility to Close it
+// once used, since nothing else holds a reference to it.
+func (provider *SqlProvider) batchInsertStmt(n int) (stmt *sqlx.Stmt, cached bool, err error) {
+	provider.batchStmtMu.Lock()
+	defer provider.batchStmtMu.Unlock()
+
+	if stmt, ok := provider.batchStmts[n]; ok {
+		return stmt, true, nil
+	}
+
+	stmt, err = provider.db.Preparex(provider.batchInsertQuery(n))
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to prepare batch insert statement for %d rows: %v", n, err)
+	}
+	if n <= maxCachedBatchSize {
+		provider.batchStmts[n] = stmt
+		return stmt, true, nil
+	}
+	return stmt, false, nil
+}
+
+func (provider *SqlProvider) batchInsertQuery(n int) string {
+	placeholders := make([]string, n)
+	for i := range placeholders {
+		placeholders[i] = "(?,?,?,?,?)"
+	}
+	values := strings.Join(placeholders, ",")
+
+	if provider.driver == "postgres" {
+		return provider.rebind(fmt.Sprintf(`INSERT INTO events (actor_name,event_type,event_index,event,codec) VALUES %s
+			ON CONFLICT (actor_name,event_index) DO UPDATE SET event_type = EXCLUDED.event_type, event = EXCLUDED.event, codec = EXCLUDED.codec`, values))
+	}
+	return provider.rebind(fmt.Sprintf("INSERT OR REPLACE INTO events (actor_name,event_type,event_index,event,codec) VALUES %s", values))
+}
@@ -0,0 +1,64 @@
+package persistence
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func newTestProvider(driver string) *SqlProvider {
+	return &SqlProvider{driver: driver, db: sqlx.NewDb(nil, driver)}
+}
+
+func TestUpsertEventQueryPerDriver(t *testing.T) {
+	cases := []struct {
+		driver       string
+		wantContains []string
+	}{
+		{"sqlite3", []string{"INSERT OR REPLACE INTO events", "?"}},
+		{"mysql", []string{"INSERT OR REPLACE INTO events", "?"}},
+		{"postgres", []string{"INSERT INTO events", "ON CONFLICT (actor_name,event_index)", "$1"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.driver, func(t *testing.T) {
+			query := newTestProvider(c.driver).upsertEventQuery()
+			for _, want := range c.wantContains {
+				if !strings.Contains(query, want) {
+					t.Errorf("upsertEventQuery() for %s = %q, want it to contain %q", c.driver, query, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchInsertQueryPerDriver(t *testing.T) {
+	cases := []struct {
+		driver       string
+		wantContains []string
+	}{
+		{"sqlite3", []string{"INSERT OR REPLACE INTO events", "(?,?,?,?,?),(?,?,?,?,?)"}},
+		{"postgres", []string{"ON CONFLICT (actor_name,event_index)", "($1,$2,$3,$4,$5),($6,$7,$8,$9,$10)"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.driver, func(t *testing.T) {
+			query := newTestProvider(c.driver).batchInsertQuery(2)
+			for _, want := range c.wantContains {
+				if !strings.Contains(query, want) {
+					t.Errorf("batchInsertQuery(2) for %s = %q, want it to contain %q", c.driver, query, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchInsertQueryRowCount(t *testing.T) {
+	provider := newTestProvider("sqlite3")
+
+	query := provider.batchInsertQuery(3)
+	if got := strings.Count(query, "(?,?,?,?,?)"); got != 3 {
+		t.Errorf("batchInsertQuery(3) has %d value groups, want 3 (query: %q)", got, query)
+	}
+}
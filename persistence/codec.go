@@ -0,0 +1,249 @@
+package persistence
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/linkedin/goavro/v2"
+)
+
+// Codec controls how a persisted message is turned into bytes on the wire
+// (and back), so the events/snapshots tables aren't locked into raw
+// protobuf. A Codec itself accepts any value, not only proto.Message, but
+// SqlProvider and RedisProvider receive events and snapshots through
+// PersistEvent/PersistSnapshot, which take proto.Message only. Every row
+// records which Codec wrote it via a codec column, so SqlProvider stays able
+// to decode rows written under a codec that isn't the one currently
+// configured - ProtoCodec rows are always decodable, and any other Codec an
+// operator is migrating away from can be kept decodable via
+// SqlProviderOption's WithDecodeCodecs.
+type Codec interface {
+	Name() string
+	Marshal(msg interface{}) (data []byte, typeName string, err error)
+	Unmarshal(typeName string, data []byte) (interface{}, error)
+}
+
+// TypeRegistry maps a type name (as produced by typeNameOf) back to the
+// reflect.Type Unmarshal should allocate for it. Unlike ProtoCodec, which
+// resolves a type name through protobuf's own global registry, JSONCodec
+// and AvroCodec have no such mechanism for arbitrary Go types, so callers
+// populate a TypeRegistry up front via Register for every type they intend
+// to persist under those codecs.
+type TypeRegistry map[string]reflect.Type
+
+// Register adds sample's type to the registry, keyed by the same type name
+// Marshal will report when encoding a value of that type. sample is a
+// pointer, e.g. &MyEvent{}.
+func (r TypeRegistry) Register(sample interface{}) {
+	r[typeNameOf(sample)] = elemType(sample)
+}
+
+func elemType(v interface{}) reflect.Type {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// typeNameOf names v the same way for every codec that relies on a
+// TypeRegistry, so whatever Marshal reports always matches a key Register
+// added.
+func typeNameOf(v interface{}) string {
+	t := elemType(v)
+	if t.PkgPath() == "" {
+		return t.Name()
+	}
+	return t.PkgPath() + "." + t.Name()
+}
+
+// ProtoCodec is the original, default encoding: raw protobuf bytes with the
+// type resolved through protobuf's own global type registry. msg must
+// implement proto.Message.
+type ProtoCodec struct{}
+
+func (ProtoCodec) Name() string { return "protobuf" }
+
+func (ProtoCodec) Marshal(msg interface{}) ([]byte, string, error) {
+	message, ok := msg.(proto.Message)
+	if !ok {
+		return nil, "", fmt.Errorf("protobuf codec: %T does not implement proto.Message", msg)
+	}
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, proto.MessageName(message), nil
+}
+
+func (ProtoCodec) Unmarshal(typeName string, data []byte) (interface{}, error) {
+	message, err := newProtoMessage(typeName)
+	if err != nil {
+		return nil, err
+	}
+	if err := proto.Unmarshal(data, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// JSONCodec stores messages as JSON, which reads and migrates more easily
+// than protobuf's binary tags at the cost of size. It resolves a type name
+// back to a concrete Go type via its own TypeRegistry rather than
+// protobuf's global one, so it isn't limited to persisting proto.Message
+// types.
+type JSONCodec struct {
+	registry TypeRegistry
+}
+
+// NewJSONCodec returns a JSONCodec that resolves types to decode through
+// registry.
+func NewJSONCodec(registry TypeRegistry) JSONCodec {
+	return JSONCodec{registry: registry}
+}
+
+func (c JSONCodec) Name() string { return "json" }
+
+func (c JSONCodec) Marshal(msg interface{}) ([]byte, string, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, typeNameOf(msg), nil
+}
+
+func (c JSONCodec) Unmarshal(typeName string, data []byte) (interface{}, error) {
+	t, ok := c.registry[typeName]
+	if !ok {
+		return nil, fmt.Errorf("json codec: no type registered for %s", typeName)
+	}
+	value := reflect.New(t).Interface()
+	if err := json.Unmarshal(data, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// AvroSchemaRegistry resolves the Avro schema to use for a given type name,
+// e.g. backed by Confluent's schema registry or a local map.
+type AvroSchemaRegistry interface {
+	Schema(typeName string) (string, error)
+}
+
+// AvroCodec stores messages as Avro binary, encoded against a schema looked
+// up from its AvroSchemaRegistry, and resolves a type name back to a
+// concrete Go type via its own TypeRegistry. There's no direct Go
+// struct<->Avro transcoding in the Go ecosystem, so messages are bridged
+// through their JSON representation: marshalled to JSON, decoded into
+// Avro's native map[string]interface{} form, then encoded against the
+// schema (and the reverse on read).
+type AvroCodec struct {
+	schemas AvroSchemaRegistry
+	types   TypeRegistry
+
+	mu     sync.Mutex
+	codecs map[string]*goavro.Codec
+}
+
+// NewAvroCodec returns an AvroCodec that resolves Avro schemas through
+// schemas and decodes into the Go types registered in types.
+func NewAvroCodec(schemas AvroSchemaRegistry, types TypeRegistry) *AvroCodec {
+	return &AvroCodec{
+		schemas: schemas,
+		types:   types,
+		codecs:  make(map[string]*goavro.Codec),
+	}
+}
+
+func (c *AvroCodec) Name() string { return "avro" }
+
+func (c *AvroCodec) avroCodecFor(typeName string) (*goavro.Codec, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if codec, ok := c.codecs[typeName]; ok {
+		return codec, nil
+	}
+
+	schema, err := c.schemas.Schema(typeName)
+	if err != nil {
+		return nil, fmt.Errorf("avro codec: failed to resolve schema for %s: %v", typeName, err)
+	}
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		return nil, fmt.Errorf("avro codec: invalid schema for %s: %v", typeName, err)
+	}
+	c.codecs[typeName] = codec
+	return codec, nil
+}
+
+func (c *AvroCodec) Marshal(msg interface{}) ([]byte, string, error) {
+	typeName := typeNameOf(msg)
+	avroCodec, err := c.avroCodecFor(typeName)
+	if err != nil {
+		return nil, "", err
+	}
+
+	native, err := messageToNative(msg)
+	if err != nil {
+		return nil, "", err
+	}
+
+	data, err := avroCodec.BinaryFromNative(nil, native)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, typeName, nil
+}
+
+func (c *AvroCodec) Unmarshal(typeName string, data []byte) (interface{}, error) {
+	t, ok := c.types[typeName]
+	if !ok {
+		return nil, fmt.Errorf("avro codec: no type registered for %s", typeName)
+	}
+
+	avroCodec, err := c.avroCodecFor(typeName)
+	if err != nil {
+		return nil, err
+	}
+	native, _, err := avroCodec.NativeFromBinary(data)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonBytes, err := json.Marshal(native)
+	if err != nil {
+		return nil, err
+	}
+	value := reflect.New(t).Interface()
+	if err := json.Unmarshal(jsonBytes, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func messageToNative(msg interface{}) (map[string]interface{}, error) {
+	jsonBytes, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	var native map[string]interface{}
+	if err := json.Unmarshal(jsonBytes, &native); err != nil {
+		return nil, err
+	}
+	return native, nil
+}
+
+// newProtoMessage resolves typeName through protobuf's global type registry
+// and allocates a zero value of it, the same lookup extractData has always
+// used for raw protobuf rows.
+func newProtoMessage(typeName string) (proto.Message, error) {
+	protoType := proto.MessageType(typeName)
+	if protoType == nil {
+		return nil, fmt.Errorf("Unsupported protocol type %s", typeName)
+	}
+	return reflect.New(protoType.Elem()).Interface().(proto.Message), nil
+}
@@ -0,0 +1,106 @@
+package persistence
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/empty"
+)
+
+func TestProtoCodecMarshalUnmarshalRoundTrip(t *testing.T) {
+	codec := ProtoCodec{}
+	msg := &empty.Empty{}
+
+	data, typeName, err := codec.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Marshal() returned unexpected error: %v", err)
+	}
+
+	got, err := codec.Unmarshal(typeName, data)
+	if err != nil {
+		t.Fatalf("Unmarshal() returned unexpected error: %v", err)
+	}
+	gotMsg, ok := got.(proto.Message)
+	if !ok {
+		t.Fatalf("Unmarshal() returned %T, want a proto.Message", got)
+	}
+	if !proto.Equal(gotMsg, msg) {
+		t.Errorf("round-tripped message = %v, want %v", gotMsg, msg)
+	}
+}
+
+func TestProtoCodecMarshalRejectsNonProtoMessage(t *testing.T) {
+	codec := ProtoCodec{}
+
+	if _, _, err := codec.Marshal(struct{ Field string }{Field: "not a proto message"}); err == nil {
+		t.Errorf("Marshal() of a non-proto.Message = nil error, want an error")
+	}
+}
+
+// jsonEvent is a plain Go type with no protobuf registration, standing in
+// for the non-proto message types JSONCodec is meant to support.
+type jsonEvent struct {
+	Name  string
+	Count int
+}
+
+func TestJSONCodecMarshalUnmarshalRoundTrip(t *testing.T) {
+	registry := make(TypeRegistry)
+	registry.Register(&jsonEvent{})
+	codec := NewJSONCodec(registry)
+	msg := &jsonEvent{Name: "widgets", Count: 3}
+
+	data, typeName, err := codec.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Marshal() returned unexpected error: %v", err)
+	}
+
+	got, err := codec.Unmarshal(typeName, data)
+	if err != nil {
+		t.Fatalf("Unmarshal() returned unexpected error: %v", err)
+	}
+	gotMsg, ok := got.(*jsonEvent)
+	if !ok {
+		t.Fatalf("Unmarshal() returned %T, want *jsonEvent", got)
+	}
+	if *gotMsg != *msg {
+		t.Errorf("round-tripped message = %+v, want %+v", gotMsg, msg)
+	}
+}
+
+func TestJSONCodecMarshalUnmarshalRoundTripProtoMessage(t *testing.T) {
+	registry := make(TypeRegistry)
+	registry.Register(&empty.Empty{})
+	codec := NewJSONCodec(registry)
+	msg := &empty.Empty{}
+
+	data, typeName, err := codec.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Marshal() returned unexpected error: %v", err)
+	}
+
+	got, err := codec.Unmarshal(typeName, data)
+	if err != nil {
+		t.Fatalf("Unmarshal() returned unexpected error: %v", err)
+	}
+	if _, ok := got.(*empty.Empty); !ok {
+		t.Fatalf("Unmarshal() returned %T, want *empty.Empty", got)
+	}
+}
+
+func TestJSONCodecUnmarshalUnregisteredType(t *testing.T) {
+	codec := NewJSONCodec(make(TypeRegistry))
+
+	if _, err := codec.Unmarshal("unregistered.Type", []byte("{}")); err == nil {
+		t.Errorf("Unmarshal() of an unregistered type = nil error, want an error")
+	}
+}
+
+func TestCodecNames(t *testing.T) {
+	if got := (ProtoCodec{}).Name(); got != "protobuf" {
+		t.Errorf("ProtoCodec.Name() = %q, want %q", got, "protobuf")
+	}
+	if got := (JSONCodec{}).Name(); got != "json" {
+		t.Errorf("JSONCodec.Name() = %q, want %q", got, "json")
+	}
+}
@@ -0,0 +1,343 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/mediocregopher/radix.v2/pool"
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/sirupsen/logrus"
+)
+
+// RedisProvider is a persistence.ProviderState backed by Redis, intended for
+// actor systems that need faster-than-SQL event persistence. Events for an
+// actor are stored as a sorted set keyed by "events:{actorName}" (scored by
+// event index) and snapshots as a hash keyed by "snapshot:{actorName}".
+type RedisProvider struct {
+	snapshotInterval int
+	pool             *pool.Pool
+	codec            Codec
+	codecs           map[string]Codec
+
+	retryCfg retryConfig
+	breaker  *circuitBreaker
+
+	bufferMu sync.Mutex
+	buffer   []bufferedEvent
+	draining int32
+}
+
+func eventsKey(actorName string) string {
+	return "events:" + actorName
+}
+
+func snapshotKey(actorName string) string {
+	return "snapshot:" + actorName
+}
+
+// NewRedisProvider dials a Redis connection pool against url (e.g.
+// redis://host:port/db) and returns a RedisProvider backed by it.
+func NewRedisProvider(redisUrl *url.URL, snapshotInterval int) (*RedisProvider, error) {
+	addr := redisUrl.Host
+	db := 0
+	if dbStr := strings.TrimPrefix(redisUrl.Path, "/"); dbStr != "" {
+		var err error
+		db, err = strconv.Atoi(dbStr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid redis db %s", dbStr)
+		}
+	}
+
+	p, err := pool.NewCustom("tcp", addr, 16, func(network, addr string) (*redis.Client, error) {
+		client, err := redis.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if db != 0 {
+			if err := client.Cmd("SELECT", db).Err; err != nil {
+				client.Close()
+				return nil, err
+			}
+		}
+		return client, nil
+	})
+	if err != nil {
+		log.WithField("addr", addr).WithError(err).Error("couldn't connect to redis")
+		return nil, err
+	}
+
+	codec := ProtoCodec{}
+	retryCfg := retryConfigFromEnv()
+
+	log.WithField("db_url", redisUrl.String()).Info("Created Redis persistence provider")
+	return &RedisProvider{
+		snapshotInterval: snapshotInterval,
+		pool:             p,
+		codec:            codec,
+		codecs:           map[string]Codec{codec.Name(): codec},
+		retryCfg:         retryCfg,
+		breaker:          newCircuitBreaker(retryCfg.failureThreshold, retryCfg.resetTimeout),
+	}, nil
+}
+
+func (provider *RedisProvider) Restart() {}
+
+func (provider *RedisProvider) GetSnapshotInterval() int {
+	return provider.snapshotInterval
+}
+
+// withRetry runs op against a pooled connection, retrying it according to
+// provider.retryCfg and tripping provider.breaker on repeated failure - the
+// same treatment SqlProvider gives its SQL calls.
+func (provider *RedisProvider) withRetry(op func(conn *redis.Client) error) error {
+	if !provider.breaker.Allow() {
+		return errCircuitOpen
+	}
+
+	var err error
+	for attempt := 1; attempt <= provider.retryCfg.maxAttempts; attempt++ {
+		var conn *redis.Client
+		if conn, err = provider.pool.Get(); err == nil {
+			err = op(conn)
+			provider.pool.Put(conn)
+			if err == nil {
+				provider.breaker.RecordSuccess()
+				return nil
+			}
+		}
+		log.WithError(err).WithField("attempt", attempt).Warn("Redis call failed, retrying")
+		time.Sleep(provider.retryCfg.backoff)
+	}
+	provider.breaker.RecordFailure()
+	return err
+}
+
+func (provider *RedisProvider) GetSnapshot(actorName string) (snapshot interface{}, eventIndex int, ok bool) {
+	var fields []*redis.Resp
+	err := provider.withRetry(func(conn *redis.Client) error {
+		arr, err := conn.Cmd("HMGET", snapshotKey(actorName), "type", "event_index", "data", "codec").Array()
+		if err != nil {
+			return err
+		}
+		fields = arr
+		return nil
+	})
+	if err != nil {
+		log.WithField("actor_name", actorName).WithError(err).Error("Error getting snapshot value from redis")
+		return nil, -1, false
+	}
+
+	snapshotType, err := fields[0].Str()
+	if err != nil {
+		return nil, -1, false
+	}
+	eventIndexStr, err := fields[1].Str()
+	if err != nil {
+		return nil, -1, false
+	}
+	snapshotBytes, err := fields[2].Bytes()
+	if err != nil {
+		return nil, -1, false
+	}
+	// Snapshots persisted before the codec field existed have nothing to
+	// read here, so fall back to the original protobuf encoding.
+	codecName, err := fields[3].Str()
+	if err != nil {
+		codecName = ProtoCodec{}.Name()
+	}
+
+	eventIndex, err = strconv.Atoi(eventIndexStr)
+	if err != nil {
+		log.WithField("actor_name", actorName).WithError(err).Error("Error parsing snapshot event index from redis")
+		return nil, -1, false
+	}
+
+	message, err := extractData(provider.codecs, actorName, codecName, snapshotType, snapshotBytes)
+	if err != nil {
+		log.WithFields(logrus.Fields{"actor_name": actorName, "message_type": snapshotType}).WithError(err).Errorf("Failed to read protobuf for snapshot")
+		return nil, -1, false
+	}
+
+	return message, eventIndex, true
+}
+
+func (provider *RedisProvider) PersistSnapshot(actorName string, eventIndex int, snapshot proto.Message) {
+	snapshotBytes, snapshotType, err := provider.codec.Marshal(snapshot)
+	if err != nil {
+		log.WithField("actor_name", actorName).WithError(err).Error("Failed to encode snapshot, dropping")
+		return
+	}
+
+	err = provider.withRetry(func(conn *redis.Client) error {
+		return conn.Cmd("HMSET", snapshotKey(actorName),
+			"type", snapshotType,
+			"event_index", eventIndex,
+			"data", snapshotBytes,
+			"codec", provider.codec.Name()).Err
+	})
+	if err != nil {
+		// A missed snapshot just means the actor replays more events on its
+		// next restart, so this is not fatal - log and move on rather than
+		// taking down the whole actor system.
+		log.WithFields(logrus.Fields{"actor_name": actorName, "event_index": eventIndex}).WithError(err).Error("Failed to persist snapshot")
+	}
+}
+
+func (provider *RedisProvider) GetEvents(actorName string, eventIndexStart int, callback func(e interface{})) {
+	var members []*redis.Resp
+	err := provider.withRetry(func(conn *redis.Client) error {
+		arr, err := conn.Cmd("ZRANGEBYSCORE", eventsKey(actorName), eventIndexStart, "+inf").Array()
+		if err != nil {
+			return err
+		}
+		members = arr
+		return nil
+	})
+	if err != nil {
+		// The actor recovers from whatever snapshot it already has rather
+		// than bringing down the whole actor system over a Redis hiccup.
+		log.WithField("actor_name", actorName).WithError(err).Error("Error getting events from redis, actor will recover from snapshot only")
+		return
+	}
+
+	for _, member := range members {
+		raw, err := member.Bytes()
+		if err != nil {
+			log.WithField("actor_name", actorName).WithError(err).Error("Error reading event member, skipping")
+			continue
+		}
+
+		codecName, eventType, eventBytes, err := decodeRedisEvent(raw)
+		if err != nil {
+			log.WithField("actor_name", actorName).WithError(err).Error("Malformed event member, skipping")
+			continue
+		}
+
+		msg, err := extractData(provider.codecs, actorName, codecName, eventType, eventBytes)
+		if err != nil {
+			log.WithFields(logrus.Fields{"actor_name": actorName, "message_type": eventType}).WithError(err).Error("Error decoding event, skipping")
+			continue
+		}
+		callback(msg)
+	}
+}
+
+func (provider *RedisProvider) PersistEvent(actorName string, eventIndex int, event proto.Message) {
+	eventBytes, eventType, err := provider.codec.Marshal(event)
+	if err != nil {
+		log.WithField("actor_name", actorName).WithError(err).Error("Failed to encode event, dropping")
+		return
+	}
+
+	provider.maybeDrainBufferedEvents()
+
+	if err := provider.persistEventNow(actorName, eventIndex, eventType, eventBytes, provider.codec.Name()); err != nil {
+		log.WithFields(logrus.Fields{"actor_name": actorName, "event_index": eventIndex}).WithError(err).Error("Failed to persist event, buffering for retry")
+		provider.bufferEvent(bufferedEvent{actorName: actorName, eventIndex: eventIndex, eventType: eventType, eventBytes: eventBytes, codecName: provider.codec.Name()})
+	}
+}
+
+// persistEventNow writes a single event to the actor's sorted set. ZADD's
+// member is the whole encoded event, not just event_index, so a member
+// already present at this score from an earlier PersistEvent call (with
+// different content) is cleared first - otherwise both copies would sit at
+// the same score and GetEvents would replay the event twice.
+func (provider *RedisProvider) persistEventNow(actorName string, eventIndex int, eventType string, eventBytes []byte, codecName string) error {
+	key := eventsKey(actorName)
+	member := encodeRedisEvent(codecName, eventType, eventBytes)
+	return provider.withRetry(func(conn *redis.Client) error {
+		if err := conn.Cmd("ZREMRANGEBYSCORE", key, eventIndex, eventIndex).Err; err != nil {
+			return err
+		}
+		return conn.Cmd("ZADD", key, eventIndex, member).Err
+	})
+}
+
+// bufferEvent enqueues an event that could not be persisted so it can be
+// retried once redis is reachable again, dropping the oldest entry if the
+// bounded buffer is full.
+func (provider *RedisProvider) bufferEvent(e bufferedEvent) {
+	provider.bufferMu.Lock()
+	defer provider.bufferMu.Unlock()
+
+	if len(provider.buffer) >= maxBufferedEvents {
+		log.WithField("actor_name", provider.buffer[0].actorName).Error("Event buffer full, dropping oldest buffered event")
+		provider.buffer = provider.buffer[1:]
+	}
+	provider.buffer = append(provider.buffer, e)
+}
+
+// maybeDrainBufferedEvents kicks off an asynchronous drain of the buffered
+// event queue if one isn't already running. It's called opportunistically
+// from PersistEvent so the buffer empties soon after redis becomes
+// reachable again, but runs in its own goroutine rather than retrying each
+// buffered event inline: PersistEvent callers (and every other actor
+// sharing bufferMu) would otherwise stall behind however long the drain's
+// retries take.
+func (provider *RedisProvider) maybeDrainBufferedEvents() {
+	provider.bufferMu.Lock()
+	empty := len(provider.buffer) == 0
+	provider.bufferMu.Unlock()
+
+	if empty || provider.breaker.IsOpen() {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&provider.draining, 0, 1) {
+		return
+	}
+	go provider.drainBufferedEvents()
+}
+
+// drainBufferedEvents retries every event buffered during an outage, taking
+// the whole queue off provider.buffer up front so the retries - each a full
+// persistEventNow round-trip - run without holding bufferMu.
+func (provider *RedisProvider) drainBufferedEvents() {
+	defer atomic.StoreInt32(&provider.draining, 0)
+
+	provider.bufferMu.Lock()
+	pending := provider.buffer
+	provider.buffer = nil
+	provider.bufferMu.Unlock()
+
+	var failed []bufferedEvent
+	for _, e := range pending {
+		if err := provider.persistEventNow(e.actorName, e.eventIndex, e.eventType, e.eventBytes, e.codecName); err != nil {
+			failed = append(failed, e)
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+
+	provider.bufferMu.Lock()
+	provider.buffer = append(failed, provider.buffer...)
+	provider.bufferMu.Unlock()
+}
+
+// encodeRedisEvent packs the codec name, event type and payload into a
+// single sorted-set member, since ZADD members are opaque blobs with no
+// per-field structure.
+func encodeRedisEvent(codecName string, eventType string, eventBytes []byte) []byte {
+	header := []byte(codecName + "\x00" + eventType + "\x00")
+	return append(header, eventBytes...)
+}
+
+func decodeRedisEvent(raw []byte) (codecName string, eventType string, eventBytes []byte, err error) {
+	firstIdx := bytes.IndexByte(raw, 0)
+	if firstIdx < 0 {
+		return "", "", nil, fmt.Errorf("malformed redis event member")
+	}
+	rest := raw[firstIdx+1:]
+	secondIdx := bytes.IndexByte(rest, 0)
+	if secondIdx < 0 {
+		return "", "", nil, fmt.Errorf("malformed redis event member")
+	}
+	return string(raw[:firstIdx]), string(rest[:secondIdx]), rest[secondIdx+1:], nil
+}
@@ -0,0 +1,57 @@
+package persistence
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeDecodeRedisEventRoundTrip(t *testing.T) {
+	cases := []struct {
+		name       string
+		codecName  string
+		eventType  string
+		eventBytes []byte
+	}{
+		{"simple", "protobuf", "completer.Event", []byte{1, 2, 3}},
+		{"empty payload", "json", "completer.Empty", []byte{}},
+		{"payload contains nul bytes", "protobuf", "completer.Event", []byte{0, 1, 0, 2, 0}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			raw := encodeRedisEvent(c.codecName, c.eventType, c.eventBytes)
+
+			codecName, eventType, eventBytes, err := decodeRedisEvent(raw)
+			if err != nil {
+				t.Fatalf("decodeRedisEvent() returned unexpected error: %v", err)
+			}
+			if codecName != c.codecName {
+				t.Errorf("codecName = %q, want %q", codecName, c.codecName)
+			}
+			if eventType != c.eventType {
+				t.Errorf("eventType = %q, want %q", eventType, c.eventType)
+			}
+			if !bytes.Equal(eventBytes, c.eventBytes) {
+				t.Errorf("eventBytes = %v, want %v", eventBytes, c.eventBytes)
+			}
+		})
+	}
+}
+
+func TestDecodeRedisEventMalformed(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  []byte
+	}{
+		{"no separators at all", []byte("justsomebytes")},
+		{"only one separator", []byte("protobuf\x00rest")},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, _, _, err := decodeRedisEvent(c.raw); err == nil {
+				t.Errorf("decodeRedisEvent(%q) = nil error, want an error", c.raw)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package persistence
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/fnproject/completer/setup"
+)
+
+var errCircuitOpen = errors.New("circuit breaker open: database unreachable")
+
+// maxBufferedEvents bounds the in-memory queue failed event writes fall back
+// to (after their retries, or straight away while the circuit breaker is
+// open), so a prolonged outage can't grow it without limit.
+const maxBufferedEvents = 10000
+
+// retryConfig controls how many attempts a SQL or Redis call gets, with what
+// backoff between them, before one failure is recorded on the circuit
+// breaker, and when that breaker trips and resets.
+type retryConfig struct {
+	maxAttempts      int
+	backoff          time.Duration
+	failureThreshold int
+	resetTimeout     time.Duration
+}
+
+func retryConfigFromEnv() retryConfig {
+	cfg := retryConfig{
+		maxAttempts:      3,
+		backoff:          50 * time.Millisecond,
+		failureThreshold: 5,
+		resetTimeout:     30 * time.Second,
+	}
+	if v, err := strconv.Atoi(setup.GetString(setup.EnvDBMaxRetries)); err == nil {
+		cfg.maxAttempts = v
+	}
+	if v, err := strconv.Atoi(setup.GetString(setup.EnvDBRetryBackoffMs)); err == nil {
+		cfg.backoff = time.Duration(v) * time.Millisecond
+	}
+	if v, err := strconv.Atoi(setup.GetString(setup.EnvDBCircuitBreakerThreshold)); err == nil {
+		cfg.failureThreshold = v
+	}
+	if v, err := strconv.Atoi(setup.GetString(setup.EnvDBCircuitBreakerResetMs)); err == nil {
+		cfg.resetTimeout = time.Duration(v) * time.Millisecond
+	}
+	return cfg
+}
+
+// circuitBreaker trips after failureThreshold consecutive failures and
+// stays open for resetTimeout, after which Allow lets exactly one caller
+// through as a probe to test whether the database has recovered - every
+// other concurrent caller keeps seeing the circuit as open until that
+// probe reports back via RecordSuccess or RecordFailure, so a backend
+// that's still down isn't hit by every waiting goroutine at once.
+type circuitBreaker struct {
+	mu                  sync.Mutex
+	failureThreshold    int
+	resetTimeout        time.Duration
+	consecutiveFailures int
+	openUntil           time.Time
+	probeInFlight       bool
+}
+
+func newCircuitBreaker(failureThreshold int, resetTimeout time.Duration) *circuitBreaker {
+	return &circuitBreaker{failureThreshold: failureThreshold, resetTimeout: resetTimeout}
+}
+
+func (cb *circuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.openUntil.IsZero() {
+		return true
+	}
+	if !time.Now().After(cb.openUntil) {
+		return false
+	}
+	// resetTimeout has elapsed, but only the first caller to notice gets to
+	// probe; everyone else keeps getting rejected until it calls
+	// RecordSuccess or RecordFailure.
+	if cb.probeInFlight {
+		return false
+	}
+	cb.probeInFlight = true
+	return true
+}
+
+func (cb *circuitBreaker) RecordSuccess() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.consecutiveFailures = 0
+	cb.openUntil = time.Time{}
+	cb.probeInFlight = false
+}
+
+func (cb *circuitBreaker) RecordFailure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.consecutiveFailures++
+	if cb.consecutiveFailures >= cb.failureThreshold {
+		cb.openUntil = time.Now().Add(cb.resetTimeout)
+	}
+	cb.probeInFlight = false
+}
+
+// IsOpen reports whether the circuit is currently tripped, without
+// consuming the single probe slot Allow grants once resetTimeout elapses.
+// For callers that just want to decide whether buffered work is worth
+// attempting at all, rather than make the attempt themselves.
+func (cb *circuitBreaker) IsOpen() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return !cb.openUntil.IsZero() && !time.Now().After(cb.openUntil)
+}
+
+// bufferedEvent is an event that failed to persist (its retries ran out, or
+// the circuit breaker was open), kept around so it can be retried once the
+// database comes back.
+type bufferedEvent struct {
+	actorName  string
+	eventIndex int
+	eventType  string
+	eventBytes []byte
+	codecName  string
+}
+
+func (provider *SqlProvider) execWithRetry(stmt *sqlx.Stmt, args ...interface{}) error {
+	if !provider.breaker.Allow() {
+		return errCircuitOpen
+	}
+
+	var err error
+	for attempt := 1; attempt <= provider.retryCfg.maxAttempts; attempt++ {
+		_, err = stmt.Exec(args...)
+		if err == nil {
+			provider.breaker.RecordSuccess()
+			return nil
+		}
+		log.WithError(err).WithField("attempt", attempt).Warn("SQL exec failed, retrying")
+		time.Sleep(provider.retryCfg.backoff)
+	}
+	provider.breaker.RecordFailure()
+	return err
+}
+
+// execInTxWithRetry runs stmt inside its own transaction, retrying the whole
+// transaction on failure. Used for the multi-row batch insert, which must
+// commit or roll back as a unit.
+func (provider *SqlProvider) execInTxWithRetry(stmt *sqlx.Stmt, args ...interface{}) error {
+	if !provider.breaker.Allow() {
+		return errCircuitOpen
+	}
+
+	var err error
+	for attempt := 1; attempt <= provider.retryCfg.maxAttempts; attempt++ {
+		err = provider.execInTx(stmt, args...)
+		if err == nil {
+			provider.breaker.RecordSuccess()
+			return nil
+		}
+		log.WithError(err).WithField("attempt", attempt).Warn("SQL batch exec failed, retrying")
+		time.Sleep(provider.retryCfg.backoff)
+	}
+	provider.breaker.RecordFailure()
+	return err
+}
+
+func (provider *SqlProvider) execInTx(stmt *sqlx.Stmt, args ...interface{}) error {
+	tx, err := provider.db.Beginx()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Stmtx(stmt).Exec(args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// bufferEvent enqueues an event that could not be persisted so it can be
+// retried once the database is reachable again, dropping the oldest entry
+// if the bounded buffer is full.
+func (provider *SqlProvider) bufferEvent(e bufferedEvent) {
+	provider.bufferMu.Lock()
+	defer provider.bufferMu.Unlock()
+
+	if len(provider.buffer) >= maxBufferedEvents {
+		log.WithField("actor_name", provider.buffer[0].actorName).Error("Event buffer full, dropping oldest buffered event")
+		provider.buffer = provider.buffer[1:]
+	}
+	provider.buffer = append(provider.buffer, e)
+}
+
+// maybeDrainBufferedEvents kicks off an asynchronous drain of the buffered
+// event queue if one isn't already running. It's called opportunistically
+// from PersistEvent so the buffer empties soon after the database becomes
+// reachable again, but runs in its own goroutine rather than retrying each
+// buffered event inline: PersistEvent callers (and every other actor
+// sharing bufferMu) would otherwise stall behind however long the drain's
+// retries take.
+func (provider *SqlProvider) maybeDrainBufferedEvents() {
+	provider.bufferMu.Lock()
+	empty := len(provider.buffer) == 0
+	provider.bufferMu.Unlock()
+
+	if empty || provider.breaker.IsOpen() {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&provider.draining, 0, 1) {
+		return
+	}
+	go provider.drainBufferedEvents()
+}
+
+// drainBufferedEvents retries every event buffered during an outage,
+// taking the whole queue off provider.buffer up front so the retries -
+// each a full execWithRetry call - run without holding bufferMu.
+func (provider *SqlProvider) drainBufferedEvents() {
+	defer atomic.StoreInt32(&provider.draining, 0)
+
+	provider.bufferMu.Lock()
+	pending := provider.buffer
+	provider.buffer = nil
+	provider.bufferMu.Unlock()
+
+	var failed []bufferedEvent
+	for _, e := range pending {
+		if err := provider.execWithRetry(provider.upsertEventStmt, e.actorName, e.eventType, e.eventIndex, e.eventBytes, e.codecName); err != nil {
+			failed = append(failed, e)
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+
+	provider.bufferMu.Lock()
+	provider.buffer = append(failed, provider.buffer...)
+	provider.bufferMu.Unlock()
+}
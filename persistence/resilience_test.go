@@ -0,0 +1,88 @@
+package persistence
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerAllowsUntilThreshold(t *testing.T) {
+	cb := newCircuitBreaker(3, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if !cb.Allow() {
+			t.Fatalf("expected circuit to allow calls before the failure threshold is reached")
+		}
+		cb.RecordFailure()
+	}
+
+	if !cb.Allow() {
+		t.Fatalf("expected circuit to still allow calls one failure below the threshold")
+	}
+}
+
+func TestCircuitBreakerTripsAtThreshold(t *testing.T) {
+	cb := newCircuitBreaker(3, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		cb.RecordFailure()
+	}
+
+	if cb.Allow() {
+		t.Fatalf("expected circuit to be open after reaching the failure threshold")
+	}
+}
+
+func TestCircuitBreakerResetsAfterTimeout(t *testing.T) {
+	cb := newCircuitBreaker(1, time.Millisecond)
+
+	cb.RecordFailure()
+	if cb.Allow() {
+		t.Fatalf("expected circuit to be open immediately after tripping")
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if !cb.Allow() {
+		t.Fatalf("expected circuit to allow a probe call once resetTimeout has elapsed")
+	}
+}
+
+func TestCircuitBreakerAllowsOnlyOneProbeAfterReset(t *testing.T) {
+	cb := newCircuitBreaker(1, time.Millisecond)
+
+	cb.RecordFailure()
+	time.Sleep(5 * time.Millisecond)
+
+	const callers = 50
+	var wg sync.WaitGroup
+	var allowed int
+	var mu sync.Mutex
+	wg.Add(callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			defer wg.Done()
+			if cb.Allow() {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 1 {
+		t.Errorf("%d of %d concurrent callers were allowed through after reset, want exactly 1", allowed, callers)
+	}
+}
+
+func TestCircuitBreakerSuccessClearsFailures(t *testing.T) {
+	cb := newCircuitBreaker(2, time.Minute)
+
+	cb.RecordFailure()
+	cb.RecordSuccess()
+	cb.RecordFailure()
+
+	if !cb.Allow() {
+		t.Fatalf("expected a success to reset the consecutive failure count")
+	}
+}
@@ -10,40 +10,176 @@ import (
 	"database/sql"
 	"github.com/jmoiron/sqlx"
 	"strings"
-	"reflect"
 	"github.com/AsynkronIT/protoactor-go/persistence"
 	"github.com/fnproject/completer/setup"
 	"strconv"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
 )
 
 type SqlProvider struct {
 	snapshotInterval int
 	db               *sqlx.DB
+	driver           string
+
+	retryCfg retryConfig
+	breaker  *circuitBreaker
+
+	bufferMu sync.Mutex
+	buffer   []bufferedEvent
+	draining int32
+
+	selectSnapshotStmt *sqlx.Stmt
+	upsertSnapshotStmt *sqlx.Stmt
+	selectEventsStmt   *sqlx.Stmt
+	upsertEventStmt    *sqlx.Stmt
+
+	batchWindow time.Duration
+	batchMu     sync.Mutex
+	batches     map[string]*pendingBatch
+
+	batchStmtMu sync.Mutex
+	batchStmts  map[int]*sqlx.Stmt
+
+	codec       Codec
+	extraCodecs []Codec
+	codecs      map[string]Codec
 }
 
-var tables = [...]string{`CREATE TABLE IF NOT EXISTS events (
+// SqlProviderOption configures optional SqlProvider behaviour that most
+// callers don't need to set explicitly.
+type SqlProviderOption func(*SqlProvider)
+
+// WithCodec selects the Codec used to serialize newly persisted events and
+// snapshots. Rows written under the "protobuf" default from before this
+// option existed remain readable; rows written under any other codec are
+// readable only while that codec is the active one or is passed via
+// WithDecodeCodecs.
+func WithCodec(codec Codec) SqlProviderOption {
+	return func(provider *SqlProvider) {
+		provider.codec = codec
+	}
+}
+
+// WithDecodeCodecs additionally registers codecs for decoding rows
+// persisted under a codec other than the currently active one, e.g. the
+// Avro codec an operator is migrating away from. ProtoCodec and a JSONCodec
+// with an empty TypeRegistry are always registered for decoding regardless
+// of this option; that JSONCodec decodes no type, so JSON rows need a
+// JSONCodec with a populated TypeRegistry passed here (or set via WithCodec).
+func WithDecodeCodecs(codecs ...Codec) SqlProviderOption {
+	return func(provider *SqlProvider) {
+		provider.extraCodecs = append(provider.extraCodecs, codecs...)
+	}
+}
+
+// blobType returns the column type used to store raw event/snapshot bytes,
+// which differs between the SQLite/MySQL BLOB type and Postgres's BYTEA.
+func blobType(driver string) string {
+	if driver == "postgres" {
+		return "BYTEA"
+	}
+	return "BLOB"
+}
+
+func tablesFor(driver string) [2]string {
+	blob := blobType(driver)
+	return [...]string{fmt.Sprintf(`CREATE TABLE IF NOT EXISTS events (
 	actor_name varchar(255) NOT NULL,
 	event_type varchar(255) NOT NULL,
 	event_index int NOT NULL,
-	event BLOB NOT NULL);`,
+	event %s NOT NULL,
+	codec varchar(32) NOT NULL DEFAULT 'protobuf',
+	PRIMARY KEY (actor_name, event_index));`, blob),
 
-	`CREATE TABLE IF NOT EXISTS snapshots (
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS snapshots (
 	actor_name varchar(255) NOT NULL PRIMARY KEY ,
 	snapshot_type varchar(255) NOT NULL,
 	event_index int NOT NULL,
-	snapshot BLOB NOT NULL);`,
+	snapshot %s NOT NULL,
+	codec varchar(32) NOT NULL DEFAULT 'protobuf');`, blob),
+	}
 }
 
-var log = logrus.New().WithField("logger", "persistence")
+// addCodecColumn adds the codec column to table if it isn't already there,
+// so databases created before the codec column existed pick it up on
+// upgrade. Postgres supports ADD COLUMN IF NOT EXISTS directly; sqlite3 and
+// mysql don't, so for those the "column already exists" error from a second
+// run is swallowed instead.
+func addCodecColumn(db *sqlx.DB, driver string, table string) error {
+	column := "codec varchar(32) NOT NULL DEFAULT 'protobuf'"
+	if driver == "postgres" {
+		_, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s", table, column))
+		return err
+	}
 
-func NewSqlProvider(url *url.URL, snapshotInterval int) (*SqlProvider, error) {
+	_, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table, column))
+	if err != nil && !isAlreadyExistsErr(err) {
+		return err
+	}
+	return nil
+}
 
-	driver := url.Scheme
+// ensureEventsPrimaryKey adds the composite (actor_name, event_index)
+// primary key to the events table if it isn't already there, so the
+// ON CONFLICT/INSERT OR REPLACE dedup logic in batchInsertQuery has a
+// constraint to match against on a database created before that logic
+// existed - without it, those statements silently insert duplicate rows
+// per (actor_name, event_index) instead of deduping.
+//
+// Postgres and MySQL can both add the constraint to an existing table;
+// sqlite3 has no ALTER TABLE support for adding a primary key at all, so a
+// database upgrading from before this migration existed needs its events
+// table rebuilt manually (dump the rows, recreate the table so tablesFor's
+// CREATE TABLE picks up the primary key, reload the rows).
+func ensureEventsPrimaryKey(db *sqlx.DB, driver string) error {
+	var err error
 	switch driver {
-	case "mysql", "sqlite3":
+	case "postgres":
+		_, err = db.Exec("ALTER TABLE events ADD CONSTRAINT events_pkey PRIMARY KEY (actor_name, event_index)")
+	case "mysql":
+		_, err = db.Exec("ALTER TABLE events ADD PRIMARY KEY (actor_name, event_index)")
+	case "sqlite3":
+		log.Warn("sqlite3 does not support adding a primary key to an existing table; if this events table predates the composite primary key, rebuild it manually to restore event deduping")
+		return nil
 	default:
+		return nil
+	}
+	if err != nil && !isAlreadyExistsErr(err) {
+		return err
+	}
+	return nil
+}
+
+func isAlreadyExistsErr(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "duplicate column") ||
+		strings.Contains(msg, "already exists") ||
+		strings.Contains(msg, "multiple primary key")
+}
 
-		return nil, fmt.Errorf("Invalid db driver %s", driver)
+var log = logrus.New().WithField("logger", "persistence")
+
+// normalizeDriver maps the URL scheme to the sql driver name registered for
+// it, since "postgresql" is an accepted alias for the "postgres" driver.
+func normalizeDriver(scheme string) (string, error) {
+	switch scheme {
+	case "mysql", "sqlite3", "postgres":
+		return scheme, nil
+	case "postgresql":
+		return "postgres", nil
+	default:
+		return "", fmt.Errorf("Invalid db driver %s", scheme)
+	}
+}
+
+func NewSqlProvider(url *url.URL, snapshotInterval int, opts ...SqlProviderOption) (*SqlProvider, error) {
+
+	driver, err := normalizeDriver(url.Scheme)
+	if err != nil {
+		return nil, err
 	}
 
 	if driver == "sqlite3" {
@@ -56,6 +192,9 @@ func NewSqlProvider(url *url.URL, snapshotInterval int) (*SqlProvider, error) {
 	var uri = url.String()
 
 	uri = strings.TrimPrefix(url.String(), url.Scheme+"://")
+	if driver == "postgres" {
+		uri = "postgres://" + uri
+	}
 
 	sqldb, err := sql.Open(driver, uri)
 	if err != nil {
@@ -76,18 +215,92 @@ func NewSqlProvider(url *url.URL, snapshotInterval int) (*SqlProvider, error) {
 	case "sqlite3":
 		sqlxDb.SetMaxOpenConns(1)
 	}
-	for _, v := range tables {
+	for _, v := range tablesFor(driver) {
 		_, err = sqlxDb.Exec(v)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to create database table %s: %v", v, err)
 		}
 	}
 
-	log.WithField("db_url", url.String()).Info("Created SQL persistence provider")
-	return &SqlProvider{
+	// tablesFor's CREATE TABLE IF NOT EXISTS is a no-op against a table that
+	// already exists, so a database created before the codec column existed
+	// needs it added explicitly.
+	for _, table := range []string{"events", "snapshots"} {
+		if err := addCodecColumn(sqlxDb, driver, table); err != nil {
+			return nil, fmt.Errorf("Failed to migrate codec column onto table %s: %v", table, err)
+		}
+	}
+
+	// Likewise, a pre-existing events table needs the composite primary key
+	// the dedup logic in batchInsertQuery relies on added explicitly.
+	if err := ensureEventsPrimaryKey(sqlxDb, driver); err != nil {
+		return nil, fmt.Errorf("Failed to migrate primary key onto table events: %v", err)
+	}
+
+	retryCfg := retryConfigFromEnv()
+
+	provider := &SqlProvider{
 		snapshotInterval: snapshotInterval,
 		db:               sqlxDb,
-	}, nil
+		driver:           driver,
+		retryCfg:         retryCfg,
+		breaker:          newCircuitBreaker(retryCfg.failureThreshold, retryCfg.resetTimeout),
+		batchWindow:      batchWindowFromEnv(),
+		batches:          make(map[string]*pendingBatch),
+		batchStmts:       make(map[int]*sqlx.Stmt),
+		codec:            ProtoCodec{},
+	}
+	for _, opt := range opts {
+		opt(provider)
+	}
+	// ProtoCodec is always decodable, so switching the active codec away
+	// from it doesn't strand rows it already wrote. The default JSONCodec
+	// entry has an empty TypeRegistry and decodes no type. Anything else
+	// (e.g. Avro, which needs a schema registry, or a JSONCodec with a
+	// populated TypeRegistry) is only decodable if it's the active codec or
+	// was registered explicitly via WithDecodeCodecs.
+	provider.codecs = map[string]Codec{
+		ProtoCodec{}.Name(): ProtoCodec{},
+		JSONCodec{}.Name():  JSONCodec{},
+	}
+	for _, codec := range provider.extraCodecs {
+		provider.codecs[codec.Name()] = codec
+	}
+	provider.codecs[provider.codec.Name()] = provider.codec
+
+	if err := provider.prepareStatements(); err != nil {
+		return nil, err
+	}
+
+	log.WithField("db_url", url.String()).Info("Created SQL persistence provider")
+	return provider, nil
+}
+
+// prepareStatements caches the prepared form of the four queries every
+// SqlProvider call goes through, avoiding a parse/plan on each call.
+func (provider *SqlProvider) prepareStatements() error {
+	var err error
+	if provider.selectSnapshotStmt, err = provider.db.Preparex(provider.rebind(
+		"SELECT snapshot_type,event_index,snapshot,codec FROM snapshots WHERE actor_name = ?")); err != nil {
+		return fmt.Errorf("Failed to prepare select snapshot statement: %v", err)
+	}
+	if provider.upsertSnapshotStmt, err = provider.db.Preparex(provider.upsertSnapshotQuery()); err != nil {
+		return fmt.Errorf("Failed to prepare upsert snapshot statement: %v", err)
+	}
+	if provider.selectEventsStmt, err = provider.db.Preparex(provider.rebind(
+		"SELECT event_type,event_index,event,codec FROM events where actor_name = ? AND event_index >= ? ORDER BY event_index ASC")); err != nil {
+		return fmt.Errorf("Failed to prepare select events statement: %v", err)
+	}
+	if provider.upsertEventStmt, err = provider.db.Preparex(provider.upsertEventQuery()); err != nil {
+		return fmt.Errorf("Failed to prepare upsert event statement: %v", err)
+	}
+	return nil
+}
+
+// rebind translates a query written with "?" placeholders into the bind
+// syntax the provider's driver expects (Postgres needs "$1, $2, ...").
+func (provider *SqlProvider) rebind(query string) string {
+	return provider.db.Rebind(query)
 }
 
 func (provider *SqlProvider) Restart() {}
@@ -98,7 +311,7 @@ func (provider *SqlProvider) GetSnapshotInterval() int {
 
 func (provider *SqlProvider) GetSnapshot(actorName string) (snapshot interface{}, eventIndex int, ok bool) {
 
-	row := provider.db.QueryRowx("SELECT snapshot_type,event_index,snapshot FROM snapshots WHERE actor_name = ?", actorName)
+	row := provider.selectSnapshotStmt.QueryRowx(actorName)
 
 	if row.Err() != nil {
 		log.WithField("actor_name", actorName).Errorf("Error getting snapshot value from DB ", row.Err())
@@ -107,8 +320,9 @@ func (provider *SqlProvider) GetSnapshot(actorName string) (snapshot interface{}
 
 	var snapshotType string
 	var snapshotBytes []byte
+	var codecName string
 
-	err := row.Scan(&snapshotType, &eventIndex, &snapshotBytes)
+	err := row.Scan(&snapshotType, &eventIndex, &snapshotBytes, &codecName)
 	if err == sql.ErrNoRows {
 		return nil, -1, false
 	}
@@ -117,7 +331,7 @@ func (provider *SqlProvider) GetSnapshot(actorName string) (snapshot interface{}
 		log.WithField("actor_name", actorName).Errorf("Error snapshot value from DB ", err)
 		return nil, -1, false
 	}
-	message, err := extractData(actorName, snapshotType, snapshotBytes)
+	message, err := extractData(provider.codecs, actorName, codecName, snapshotType, snapshotBytes)
 
 	if err != nil {
 		log.WithFields(logrus.Fields{"actor_name": actorName, "message_type": snapshotType}).WithError(err).Errorf("Failed to read  protobuf for snapshot")
@@ -127,47 +341,91 @@ func (provider *SqlProvider) GetSnapshot(actorName string) (snapshot interface{}
 	return message, eventIndex, true
 }
 
-func extractData(actorName string, msgTypeName string, msgBytes []byte) (proto.Message, error) {
-	protoType := proto.MessageType(msgTypeName)
-
-	if protoType == nil {
-		log.WithFields(logrus.Fields{"actor_name": actorName, "message_type": msgTypeName}).Errorf("protocol type not supported by protobuf")
-		return nil, fmt.Errorf("Unsupported protocol type %s", protoType)
+// extractData decodes a persisted row using whichever Codec wrote it,
+// looked up by codecName from codecs - which may differ from the
+// provider's currently-configured codec if it was persisted before a codec
+// migration.
+func extractData(codecs map[string]Codec, actorName string, codecName string, msgTypeName string, msgBytes []byte) (interface{}, error) {
+	codec, ok := codecs[codecName]
+	if !ok {
+		log.WithFields(logrus.Fields{"actor_name": actorName, "codec": codecName}).Errorf("Unsupported codec")
+		return nil, fmt.Errorf("Unsupported codec %s", codecName)
 	}
-	t := protoType.Elem()
-	intPtr := reflect.New(t)
-	message := intPtr.Interface().(proto.Message)
 
-	err := proto.Unmarshal(msgBytes, message)
+	message, err := codec.Unmarshal(msgTypeName, msgBytes)
 	if err != nil {
+		log.WithFields(logrus.Fields{"actor_name": actorName, "message_type": msgTypeName, "codec": codecName}).WithError(err).Errorf("Failed to decode persisted message")
 		return nil, err
 	}
 	return message, nil
 }
 
+func (provider *SqlProvider) upsertSnapshotQuery() string {
+	if provider.driver == "postgres" {
+		return provider.rebind(`INSERT INTO snapshots (actor_name,snapshot_type,event_index,snapshot,codec) VALUES (?,?,?,?,?)
+			ON CONFLICT (actor_name) DO UPDATE SET snapshot_type = EXCLUDED.snapshot_type, event_index = EXCLUDED.event_index, snapshot = EXCLUDED.snapshot, codec = EXCLUDED.codec`)
+	}
+	return provider.rebind("INSERT OR REPLACE INTO snapshots (actor_name,snapshot_type,event_index,snapshot,codec) VALUES (?,?,?,?,?)")
+}
+
+func (provider *SqlProvider) upsertEventQuery() string {
+	if provider.driver == "postgres" {
+		return provider.rebind(`INSERT INTO events (actor_name,event_type,event_index,event,codec) VALUES (?,?,?,?,?)
+			ON CONFLICT (actor_name,event_index) DO UPDATE SET event_type = EXCLUDED.event_type, event = EXCLUDED.event, codec = EXCLUDED.codec`)
+	}
+	return provider.rebind("INSERT OR REPLACE INTO events (actor_name,event_type,event_index,event,codec) VALUES (?,?,?,?,?)")
+}
+
 func (provider *SqlProvider) PersistSnapshot(actorName string, eventIndex int, snapshot proto.Message) {
-	pbType := proto.MessageName(snapshot)
-	pbBytes, err := proto.Marshal(snapshot)
+	snapshotBytes, snapshotType, err := provider.codec.Marshal(snapshot)
+	if err != nil {
+		log.WithField("actor_name", actorName).WithError(err).Error("Failed to encode snapshot, dropping")
+		return
+	}
 
+	err = provider.execWithRetry(provider.upsertSnapshotStmt, actorName, snapshotType, eventIndex, snapshotBytes, provider.codec.Name())
 	if err != nil {
-		panic(err)
+		// A missed snapshot just means the actor replays more events on its
+		// next restart, so this is not fatal - log and move on rather than
+		// taking down the whole actor system.
+		log.WithFields(logrus.Fields{"actor_name": actorName, "event_index": eventIndex}).WithError(err).Error("Failed to persist snapshot")
 	}
+}
 
-	_, err = provider.db.Exec("INSERT OR REPLACE INTO snapshots (actor_name,snapshot_type,event_index,snapshot) VALUES (?,?,?,?)",
-		actorName, pbType, eventIndex, pbBytes)
+func (provider *SqlProvider) queryxWithRetry(stmt *sqlx.Stmt, args ...interface{}) (*sqlx.Rows, error) {
+	if !provider.breaker.Allow() {
+		return nil, errCircuitOpen
+	}
 
-	if err != nil {
-		panic(err)
+	var rows *sqlx.Rows
+	var err error
+	for attempt := 1; attempt <= provider.retryCfg.maxAttempts; attempt++ {
+		rows, err = stmt.Queryx(args...)
+		if err == nil {
+			provider.breaker.RecordSuccess()
+			return rows, nil
+		}
+		log.WithError(err).WithField("attempt", attempt).Warn("SQL query failed, retrying")
+		time.Sleep(provider.retryCfg.backoff)
 	}
+	provider.breaker.RecordFailure()
+	return nil, err
 }
 
+// GetEvents streams events for actorName starting at eventIndexStart. The
+// caller (protoactor-go's actor recovery) has already read whatever
+// snapshot it's going to apply and passes the index to resume from, so
+// eventIndexStart is trusted as-is rather than re-derived here: re-querying
+// the snapshot on every call would risk clamping past events a concurrently
+// persisted, higher-indexed snapshot covers but the caller's in-memory
+// state never actually replayed.
 func (provider *SqlProvider) GetEvents(actorName string, eventIndexStart int, callback func(e interface{})) {
-	rows, err := provider.db.Queryx("SELECT event_type,event_index,event FROM events where actor_name = ? AND event_index >= ? ORDER BY event_index ASC", actorName, eventIndexStart)
+	rows, err := provider.queryxWithRetry(provider.selectEventsStmt, actorName, eventIndexStart)
 	if err != nil {
-		log.WithField("actor_name", actorName).WithError(err).Error("Error getting events value from DB ")
-
-		// DON't PANIC ?
-		panic(err)
+		// The actor recovers from whatever snapshot it already has rather
+		// than bringing down the whole actor system over a DB hiccup.
+		log.WithField("actor_name", actorName).WithError(err).Error("Error getting events from DB, actor will recover from snapshot only")
+		return
 	}
 	defer rows.Close()
 
@@ -175,11 +433,16 @@ func (provider *SqlProvider) GetEvents(actorName string, eventIndexStart int, ca
 		var eventType string
 		var eventIndex int
 		var eventBytes []byte
-		rows.Scan(&eventType, &eventIndex, &eventBytes)
+		var codecName string
+		if err := rows.Scan(&eventType, &eventIndex, &eventBytes, &codecName); err != nil {
+			log.WithField("actor_name", actorName).WithError(err).Error("Error scanning event row, skipping")
+			continue
+		}
 
-		msg, err := extractData(actorName, eventType, eventBytes)
+		msg, err := extractData(provider.codecs, actorName, codecName, eventType, eventBytes)
 		if err != nil {
-			panic(err)
+			log.WithFields(logrus.Fields{"actor_name": actorName, "message_type": eventType}).WithError(err).Error("Error decoding event, skipping")
+			continue
 		}
 		callback(msg)
 	}
@@ -187,19 +450,17 @@ func (provider *SqlProvider) GetEvents(actorName string, eventIndexStart int, ca
 }
 
 func (provider *SqlProvider) PersistEvent(actorName string, eventIndex int, event proto.Message) {
-	pbType := proto.MessageName(event)
-	pbBytes, err := proto.Marshal(event)
-
+	eventBytes, eventType, err := provider.codec.Marshal(event)
 	if err != nil {
-		panic(err)
+		log.WithField("actor_name", actorName).WithError(err).Error("Failed to encode event, dropping")
+		return
 	}
 
-	_, err = provider.db.Exec("INSERT OR REPLACE INTO events (actor_name,event_type,event_index,event) VALUES (?,?,?,?)",
-		actorName, pbType, eventIndex, pbBytes)
+	provider.maybeDrainBufferedEvents()
 
-	if err != nil {
-		panic(err)
-	}
+	// Rather than a round-trip per event, writes for this actor are grouped
+	// into a single multi-row INSERT once the batch window elapses.
+	provider.enqueueEvent(actorName, eventRow{eventIndex: eventIndex, eventType: eventType, eventBytes: eventBytes, codecName: provider.codec.Name()})
 }
 
 func NewProviderFromEnv() (persistence.ProviderState, error) {
@@ -218,5 +479,27 @@ func NewProviderFromEnv() (persistence.ProviderState, error) {
 		log.Info("Using in-memory persistence")
 		return persistence.NewInMemoryProvider(snapshotInterval), nil
 	}
-	return NewSqlProvider(dbUrl, snapshotInterval)
+	if dbUrl.Scheme == "redis" {
+		return NewRedisProvider(dbUrl, snapshotInterval)
+	}
+	return NewSqlProvider(dbUrl, snapshotInterval, WithCodec(codecFromEnv()))
+}
+
+// codecFromEnv resolves setup.EnvDBCodec to the Codec newly persisted rows
+// are written with. The JSON codec it builds has an empty TypeRegistry,
+// since that can't be expressed as a single env var either, so it can
+// write rows but decodes no type when reading them back - an app that
+// persists under JSON needs to call WithCodec directly with its own
+// TypeRegistry. Avro isn't selectable here at all,
+// since it also needs a schema registry; use WithCodec directly for that.
+func codecFromEnv() Codec {
+	switch name := setup.GetString(setup.EnvDBCodec); name {
+	case "", ProtoCodec{}.Name():
+		return ProtoCodec{}
+	case JSONCodec{}.Name():
+		return NewJSONCodec(make(TypeRegistry))
+	default:
+		log.WithField("codec", name).Warn("Unknown codec configured, falling back to protobuf")
+		return ProtoCodec{}
+	}
 }
\ No newline at end of file
@@ -0,0 +1,46 @@
+// Package setup centralizes the environment variables the completer reads
+// its configuration from.
+package setup
+
+import "os"
+
+const (
+	// EnvDBURL is the URL of the persistence backend, e.g.
+	// "sqlite3:///data/completer.db" or "redis://localhost:6379".
+	EnvDBURL = "COMPLETER_DB_URL"
+	// EnvSnapshotInterval is how many events a persistence.ProviderState
+	// should accumulate between snapshots.
+	EnvSnapshotInterval = "COMPLETER_SNAPSHOT_INTERVAL"
+
+	// EnvDBBatchWindowMs is how long, in milliseconds, SqlProvider waits to
+	// group PersistEvent calls for the same actor into a single multi-row
+	// insert.
+	EnvDBBatchWindowMs = "COMPLETER_DB_BATCH_WINDOW_MS"
+
+	// EnvDBMaxRetries is how many attempts, the first one included, a
+	// failing SQL or Redis call gets before the circuit breaker records a
+	// failure.
+	EnvDBMaxRetries = "COMPLETER_DB_MAX_RETRIES"
+	// EnvDBRetryBackoffMs is how long, in milliseconds, to wait between
+	// retry attempts.
+	EnvDBRetryBackoffMs = "COMPLETER_DB_RETRY_BACKOFF_MS"
+	// EnvDBCircuitBreakerThreshold is how many consecutive failures trip the
+	// circuit breaker.
+	EnvDBCircuitBreakerThreshold = "COMPLETER_DB_CIRCUIT_BREAKER_THRESHOLD"
+	// EnvDBCircuitBreakerResetMs is how long, in milliseconds, the circuit
+	// breaker stays open before letting a probe call through.
+	EnvDBCircuitBreakerResetMs = "COMPLETER_DB_CIRCUIT_BREAKER_RESET_MS"
+
+	// EnvDBCodec selects the Codec SqlProvider writes newly persisted events
+	// and snapshots with: "protobuf" (default) or "json". RedisProvider
+	// ignores it and always writes protobuf. Avro requires a schema
+	// registry that can't be expressed as a single env var, so it's only
+	// reachable by passing persistence.WithCodec directly.
+	EnvDBCodec = "COMPLETER_DB_CODEC"
+)
+
+// GetString returns the value of the named environment variable, or "" if
+// it isn't set.
+func GetString(key string) string {
+	return os.Getenv(key)
+}